@@ -0,0 +1,133 @@
+// Package encoding provides content-type-specific marshalers for count
+// results, so new response formats can be added without touching the HTTP
+// handlers that use them.
+package encoding
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+)
+
+// Result is the format-agnostic payload shared by every Marshaler. Groups
+// breaks Total down by some key - country, subdivision, ASN - named by
+// GroupLabel (the JSON key holding the groups, e.g. "countries", "regions",
+// "asns") and GroupItem (the XML element name for one entry, e.g.
+// "country", "region", "asn"). Both default to "countries"/"country" when
+// left unset, matching the original /count and /countries schema.
+type Result struct {
+	Total      int
+	GroupLabel string
+	GroupItem  string
+	Groups     map[string]int
+}
+
+func (r Result) groupLabel() string {
+	if r.GroupLabel == "" {
+		return "countries"
+	}
+	return r.GroupLabel
+}
+
+func (r Result) groupItem() string {
+	if r.GroupItem == "" {
+		return "country"
+	}
+	return r.GroupItem
+}
+
+// Marshaler turns a Result into bytes for one wire format.
+type Marshaler interface {
+	// ContentType is the value to send as the response's Content-Type header.
+	ContentType() string
+	// Marshal encodes r in this format.
+	Marshal(r Result) ([]byte, error)
+}
+
+var registry = map[string]Marshaler{}
+
+// Register adds a Marshaler under a format name ("json", "xml", "csv", ...).
+// Callers pick the name from the request's path extension, "format" query
+// parameter or Accept header; main's negotiateFormat lowercases only the
+// query parameter, so the other two match case-sensitively.
+func Register(name string, m Marshaler) {
+	registry[name] = m
+}
+
+// Get looks up a Marshaler previously added with Register.
+func Get(name string) (Marshaler, bool) {
+	m, ok := registry[name]
+	return m, ok
+}
+
+func init() {
+	Register("json", jsonMarshaler{})
+	Register("xml", xmlMarshaler{})
+	Register("csv", csvMarshaler{})
+}
+
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) ContentType() string { return "application/json; charset=utf-8" }
+
+func (jsonMarshaler) Marshal(r Result) ([]byte, error) {
+	out := map[string]interface{}{"total": r.Total}
+	if len(r.Groups) > 0 {
+		out[r.groupLabel()] = r.Groups
+	}
+	return json.MarshalIndent(out, "", "	")
+}
+
+type xmlGroupItem struct {
+	XMLName xml.Name
+	Code    string `xml:"code,attr"`
+	Count   int    `xml:",chardata"`
+}
+
+type xmlCounts struct {
+	XMLName xml.Name       `xml:"counts"`
+	Total   int            `xml:"total,attr"`
+	Groups  []xmlGroupItem
+}
+
+type xmlMarshaler struct{}
+
+func (xmlMarshaler) ContentType() string { return "application/xml; charset=utf-8" }
+
+func (xmlMarshaler) Marshal(r Result) ([]byte, error) {
+	out := xmlCounts{Total: r.Total}
+	itemName := xml.Name{Local: r.groupItem()}
+	for _, code := range sortedKeys(r.Groups) {
+		out.Groups = append(out.Groups, xmlGroupItem{XMLName: itemName, Code: code, Count: r.Groups[code]})
+	}
+	b, err := xml.MarshalIndent(out, "", "	")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+type csvMarshaler struct{}
+
+func (csvMarshaler) ContentType() string { return "text/csv; charset=utf-8" }
+
+func (csvMarshaler) Marshal(r Result) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("code,count\n")
+	for _, code := range sortedKeys(r.Groups) {
+		fmt.Fprintf(&buf, "%s,%d\n", code, r.Groups[code])
+	}
+	fmt.Fprintf(&buf, "Total,%d\n", r.Total)
+	return buf.Bytes(), nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
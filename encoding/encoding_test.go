@@ -0,0 +1,78 @@
+package encoding
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONMarshalerDefaultsToCountries(t *testing.T) {
+	m, ok := Get("json")
+	if !ok {
+		t.Fatal("json marshaler not registered")
+	}
+	b, err := m.Marshal(Result{Total: 3, Groups: map[string]int{"US": 2, "GB": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["total"] != float64(3) {
+		t.Errorf("total = %v, want 3", out["total"])
+	}
+	if _, ok := out["countries"]; !ok {
+		t.Errorf("expected \"countries\" key in %s", b)
+	}
+}
+
+func TestJSONMarshalerUsesGroupLabel(t *testing.T) {
+	m, _ := Get("json")
+	b, err := m.Marshal(Result{Total: 1, GroupLabel: "regions", GroupItem: "region", Groups: map[string]int{"US-CA": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out["countries"]; ok {
+		t.Errorf("did not expect \"countries\" key in %s", b)
+	}
+	if _, ok := out["regions"]; !ok {
+		t.Errorf("expected \"regions\" key in %s", b)
+	}
+}
+
+func TestXMLMarshalerUsesGroupItem(t *testing.T) {
+	m, ok := Get("xml")
+	if !ok {
+		t.Fatal("xml marshaler not registered")
+	}
+	b, err := m.Marshal(Result{Total: 1, GroupLabel: "asns", GroupItem: "asn", Groups: map[string]int{"12345": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<asn code=\"12345\">1</asn>") {
+		t.Errorf("expected <asn> element in %s", b)
+	}
+	if strings.Contains(string(b), "<country") {
+		t.Errorf("did not expect <country> element in %s", b)
+	}
+}
+
+func TestCSVMarshaler(t *testing.T) {
+	m, ok := Get("csv")
+	if !ok {
+		t.Fatal("csv marshaler not registered")
+	}
+	b, err := m.Marshal(Result{Total: 3, Groups: map[string]int{"US": 2, "GB": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "code,count\nGB,1\nUS,2\nTotal,3\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
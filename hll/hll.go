@@ -0,0 +1,87 @@
+// Package hll implements a fixed-precision HyperLogLog cardinality
+// estimator, used to track approximate unique-visitor counts over time
+// without keeping every raw entry around.
+package hll
+
+import (
+	"math"
+	"math/bits"
+)
+
+// precision controls the register count (1<<precision) and therefore the
+// sketch's size and standard error. 12 bits gives 4096 registers and about
+// 1.6% standard error (1.04/sqrt(4096)), at roughly 4KB per encoded sketch.
+const precision = 12
+
+const numRegisters = 1 << precision
+
+// Sketch estimates the number of distinct items added to it. The zero value
+// is a valid, empty sketch.
+type Sketch struct {
+	registers [numRegisters]uint8
+}
+
+// New returns an empty Sketch.
+func New() *Sketch {
+	return &Sketch{}
+}
+
+// Add records one observation of data.
+func (s *Sketch) Add(data []byte) {
+	h := fnv1a(data)
+	idx := h >> (64 - precision)
+	rho := uint8(bits.LeadingZeros64(h<<precision)) + 1
+	if rho > s.registers[idx] {
+		s.registers[idx] = rho
+	}
+}
+
+// Merge folds other into s. Merge is commutative and idempotent, so buckets
+// can be combined in any order and re-merged safely.
+func (s *Sketch) Merge(other *Sketch) {
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+// Count returns the estimated number of distinct items added to s.
+func (s *Sketch) Count() uint64 {
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1.0 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/float64(numRegisters))
+	estimate := alpha * numRegisters * numRegisters / sum
+	if estimate <= 2.5*numRegisters && zeros > 0 {
+		estimate = numRegisters * math.Log(float64(numRegisters)/float64(zeros))
+	}
+	return uint64(estimate)
+}
+
+// MarshalBinary encodes s as its raw register bytes.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	out := make([]byte, numRegisters)
+	copy(out, s.registers[:])
+	return out, nil
+}
+
+// UnmarshalBinary decodes a Sketch previously encoded with MarshalBinary.
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	copy(s.registers[:], b)
+	return nil
+}
+
+func fnv1a(data []byte) uint64 {
+	var h uint64 = 14695981039346656037
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,100 @@
+// Package httpcache is a small single-flight + TTL caching middleware for
+// idempotent GET handlers, keyed by request path, query string and Accept
+// header.
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type entry struct {
+	body        []byte
+	contentType string
+	status      int
+	expires     time.Time
+}
+
+// Cache serves a wrapped handler's responses from memory for ttl, and
+// coalesces concurrent cache misses for the same key into a single call to
+// the handler.
+type Cache struct {
+	ttl   time.Duration
+	mu    sync.RWMutex
+	items map[string]entry
+	group singleflight.Group
+}
+
+// New builds a Cache whose entries live for ttl.
+func New(ttl time.Duration) *Cache {
+	return &Cache{ttl: ttl, items: make(map[string]entry)}
+}
+
+// cacheKey folds in the Accept header alongside path and query, since
+// content negotiation (see main.negotiateFormat) can pick a different
+// response for the same path+query depending on it.
+func cacheKey(r *http.Request) string {
+	return r.URL.Path + "?" + r.URL.RawQuery + "#" + r.Header.Get("Accept")
+}
+
+// Wrap returns h backed by the cache: a hit within ttl is served straight
+// from memory, a miss runs h once per key even under concurrent callers.
+func (c *Cache) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := cacheKey(r)
+		if e, ok := c.get(key); ok {
+			writeEntry(w, e)
+			return
+		}
+		v, err, _ := c.group.Do(key, func() (interface{}, error) {
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			e := entry{
+				body:        rec.Body.Bytes(),
+				contentType: rec.Header().Get("Content-Type"),
+				status:      rec.Code,
+				expires:     time.Now().Add(c.ttl),
+			}
+			c.mu.Lock()
+			c.items[key] = e
+			c.mu.Unlock()
+			return e, nil
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeEntry(w, v.(entry))
+	}
+}
+
+// writeEntry replays a cached (or freshly recorded) response, including the
+// status code the underlying handler actually decided on.
+func writeEntry(w http.ResponseWriter, e entry) {
+	if e.contentType != "" {
+		w.Header().Set("Content-Type", e.contentType)
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+func (c *Cache) get(key string) (entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, ok := c.items[key]
+	if !ok || time.Now().After(e.expires) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// Close discards every cached entry.
+func (c *Cache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]entry)
+}
@@ -3,19 +3,23 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash"
 	"log"
-	"net"
 	"net/http"
 	"os"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/oschwald/geoip2-golang"
-	bolt "go.etcd.io/bbolt"
+	"github.com/hrfee/ipcount/encoding"
+	"github.com/hrfee/ipcount/httpcache"
+	"github.com/hrfee/ipcount/ratelimit"
+	"github.com/hrfee/ipcount/storage"
+	_ "github.com/hrfee/ipcount/storage/bolt"
+	_ "github.com/hrfee/ipcount/storage/memory"
+	_ "github.com/hrfee/ipcount/storage/redis"
 	"gopkg.in/ini.v1"
 )
 
@@ -23,18 +27,6 @@ const (
 	NAME = "ipcount"
 )
 
-type Threshold struct {
-	duration time.Duration
-}
-
-func NewThreshold(days, hours, minutes int) *Threshold {
-	return &Threshold{(time.Duration((days*24)+hours) * time.Hour) + (time.Duration(minutes) * time.Minute)}
-}
-
-func (threshold *Threshold) Valid(t time.Time) bool {
-	return t.Add(threshold.duration).After(time.Now())
-}
-
 type Hash interface {
 	Hash(string) []byte
 }
@@ -53,209 +45,237 @@ func NewHMACSha256(secret string) *HMACSha256 {
 	return &HMACSha256{hmac.New(sha256.New, []byte(secret))}
 }
 
-// Entry stores information about a hashed IP.
-type Entry struct {
-	LastVisit time.Time // Last visit from user
-	// Count     int       // Visit count
-	CountryISOCode string // GeoIP2 Country ID.
-}
-
-func (e *Entry) Encode() []byte {
-	unix := e.LastVisit.Unix()
-	out := make([]byte, 16)
-	country := []byte(e.CountryISOCode)
-	binary.LittleEndian.PutUint64(out, uint64(unix))
-	for i := 8; i < 8+len(country); i++ {
-		out[i] = country[i-8]
-	}
-	return out
+type Server struct {
+	db              storage.DB
+	hash            Hash
+	config          *ini.File
+	ActiveThreshold *storage.Threshold
+	GeoIP           bool
+	limiter         *ratelimit.Limiter
+	countCache      *httpcache.Cache
+	countriesCache  *httpcache.Cache
 }
 
-func DecodeEntry(b []byte) (e *Entry) {
-	e = &Entry{}
-	e.CountryISOCode = ""
-	for i := 8; i < 16; i++ {
-		if b[i] != 0 {
-			e.CountryISOCode += string(b[i])
-			b[i] = 0
-		}
+// Close releases the server's cache and storage resources.
+func (s *Server) Close() {
+	if s.countCache != nil {
+		s.countCache.Close()
+	}
+	if s.countriesCache != nil {
+		s.countriesCache.Close()
 	}
-	e.LastVisit = time.Unix(int64(binary.LittleEndian.Uint64(b)), 0)
-	return
+	s.db.Close()
 }
 
-type BoltDB struct {
-	db    *bolt.DB
-	name  []byte
-	lock  *sync.Mutex
-	GeoIP bool
-	GeoDB *geoip2.Reader
+func (s *Server) HandleVisit(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hash := s.hash.Hash(ip)
+	if s.GeoIP {
+		s.db.LogVisit(hash, time.Now(), ip)
+	} else {
+		s.db.LogVisit(hash, time.Now())
+	}
+	// log.Printf("Logged ip %s", ip)
+	w.WriteHeader(http.StatusOK)
 }
 
-func NewBoltDB(fname, name, geoip string) (*BoltDB, error) {
-	b := &BoltDB{GeoIP: geoip != ""}
-	b.lock = &sync.Mutex{}
-	b.name = []byte(name)
-	var err error
-	b.db, err = bolt.Open(fname, 0600, nil)
-	if err != nil {
-		return nil, err
+// negotiateFormat picks a response format for r: the .json/.xml/.csv suffix
+// on the request path wins, then the "format" query parameter, then the
+// Accept header, falling back to "json".
+func negotiateFormat(r *http.Request) string {
+	path := r.URL.Path
+	for _, suffix := range []string{"json", "xml", "csv"} {
+		if strings.HasSuffix(path, "."+suffix) {
+			return suffix
+		}
 	}
-	err = b.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(b.name)
-		return err
-	})
-	if err != nil {
-		return nil, err
+	if f := r.URL.Query().Get("format"); f != "" {
+		return strings.ToLower(f)
 	}
-	if b.GeoIP {
-		b.GeoDB, err = geoip2.Open(geoip)
-		if err != nil {
-			return nil, err
-		}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "xml"):
+		return "xml"
+	case strings.Contains(accept, "csv"):
+		return "csv"
 	}
-	return b, err
+	return "json"
 }
 
-func (b *BoltDB) Close() {
-	b.db.Close()
-	if b.GeoIP {
-		b.GeoDB.Close()
+func writeEncoded(w http.ResponseWriter, r *http.Request, res encoding.Result) {
+	m, ok := encoding.Get(negotiateFormat(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
 	}
-}
-
-func (b *BoltDB) LogVisit(hash []byte, t time.Time, ip ...string) error {
-	entry := &Entry{LastVisit: t}
-	if len(ip) == 1 {
-		record, err := b.GeoDB.Country(net.ParseIP(ip[0]))
-		if err == nil {
-			entry.CountryISOCode = record.Country.IsoCode
-			// } else {
-			// 	fmt.Println(err)
-		}
+	b, err := m.Marshal(res)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	return b.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(b.name)
-		return bucket.Put(hash, entry.Encode())
-	})
+	w.Header().Set("Content-Type", m.ContentType())
+	w.Write(b)
 }
 
-func (b *BoltDB) GetEntry(hash []byte) *Entry {
-	var e *Entry
-	b.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(b.name)
-		e = DecodeEntry(bucket.Get(hash))
-		return nil
-	})
-	return e
+func (s *Server) HandleCount(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, encoding.Result{Total: s.db.CountActive(s.ActiveThreshold)})
 }
 
-func (b *BoltDB) CountActive(ActiveThreshold *Threshold) (count int) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	b.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(b.name)
-		var e *Entry
-		bucket.ForEach(func(k, v []byte) error {
-			e = DecodeEntry(v)
-			if ActiveThreshold.Valid(e.LastVisit) {
-				count++
-			} else {
-				bucket.Delete(k)
-			}
-			return nil
-		})
-		return nil
-	})
-	return
+func (s *Server) HandleCountries(w http.ResponseWriter, r *http.Request) {
+	counts := s.db.CountByCountry(s.ActiveThreshold)
+	total := counts["Total"]
+	delete(counts, "Total")
+	writeEncoded(w, r, encoding.Result{Total: total, Groups: counts})
 }
 
-func (b *BoltDB) CountByCountry(ActiveThreshold *Threshold) (counts map[string]int) {
-	counts = map[string]int{"Total": 0}
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	b.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(b.name)
-		var e *Entry
-		bucket.ForEach(func(k, v []byte) error {
-			e = DecodeEntry(v)
-			if ActiveThreshold.Valid(e.LastVisit) {
-				counts["Total"]++
-				if e.CountryISOCode == "" {
-					if _, ok := counts["Unknown"]; !ok {
-						counts["Unknown"] = 0
-					}
-					counts["Unknown"]++
-				} else {
-					if _, ok := counts[e.CountryISOCode]; !ok {
-						counts[e.CountryISOCode] = 0
-					}
-					counts[e.CountryISOCode]++
-				}
-			} else {
-				bucket.Delete(k)
-			}
-			return nil
-		})
-		return nil
-	})
-	return counts
+// HandleRegions serves /regions?country=US, returning active visitor counts
+// within that country grouped by GeoIP2 subdivision.
+func (s *Server) HandleRegions(w http.ResponseWriter, r *http.Request) {
+	country := r.URL.Query().Get("country")
+	if country == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	counts := s.db.CountBySubdivision(country, s.ActiveThreshold)
+	total := counts["Total"]
+	delete(counts, "Total")
+	writeEncoded(w, r, encoding.Result{Total: total, GroupLabel: "regions", GroupItem: "region", Groups: counts})
 }
 
-type DB interface {
-	Close()
-	LogVisit([]byte, time.Time, ...string) error
-	GetEntry([]byte) *Entry
-	CountActive(*Threshold) int
-	CountByCountry(*Threshold) map[string]int
+// HandleASN serves /asn, returning active visitor counts grouped by
+// autonomous system number.
+func (s *Server) HandleASN(w http.ResponseWriter, r *http.Request) {
+	counts := s.db.CountByASN(s.ActiveThreshold)
+	total := counts["Total"]
+	delete(counts, "Total")
+	writeEncoded(w, r, encoding.Result{Total: total, GroupLabel: "asns", GroupItem: "asn", Groups: counts})
 }
 
-type Server struct {
-	db              DB
-	hash            Hash
-	config          *ini.File
-	ActiveThreshold *Threshold
-	GeoIP           bool
-}
-
-func (s *Server) HandleVisit(w http.ResponseWriter, r *http.Request) {
-	ip := r.URL.Query().Get("ip")
-	if ip == "" {
+// HandleSeries serves /series?period=hour|day&count=N, returning the
+// estimated unique-visitor count per bucket for the last N periods.
+func (s *Server) HandleSeries(w http.ResponseWriter, r *http.Request) {
+	period, err := storage.ParsePeriod(r.URL.Query().Get("period"))
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	hash := s.hash.Hash(ip)
-	if s.GeoIP {
-		s.db.LogVisit(hash, time.Now(), ip)
-	} else {
-		s.db.LogVisit(hash, time.Now())
+	n := 24
+	if c := r.URL.Query().Get("count"); c != "" {
+		if parsed, err := strconv.Atoi(c); err == nil && parsed > 0 {
+			n = parsed
+		}
 	}
-	// log.Printf("Logged ip %s", ip)
-	w.WriteHeader(http.StatusOK)
-}
-
-func (s *Server) HandleCount(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "%d", s.db.CountActive(s.ActiveThreshold))
+	counts, err := s.db.SeriesCounts(period, n)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(counts)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
 }
 
-func (s *Server) HandleCountries(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(s.db.CountByCountry(s.ActiveThreshold), "", "	")
+// HandleSeriesCountries serves /series/countries?period=hour|day&country=US&count=N,
+// returning the estimated unique-visitor count from country per bucket.
+func (s *Server) HandleSeriesCountries(w http.ResponseWriter, r *http.Request) {
+	period, err := storage.ParsePeriod(r.URL.Query().Get("period"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	country := r.URL.Query().Get("country")
+	if country == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n := 24
+	if c := r.URL.Query().Get("count"); c != "" {
+		if parsed, err := strconv.Atoi(c); err == nil && parsed > 0 {
+			n = parsed
+		}
+	}
+	counts, err := s.db.SeriesCountryCounts(period, country, n)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(counts)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "%s\n", b)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
 }
 
 func (s *Server) Serve() {
-	http.HandleFunc("/add", s.HandleVisit)
-	http.HandleFunc("/count", s.HandleCount)
-	http.HandleFunc("/countries", s.HandleCountries)
+	add := http.HandlerFunc(s.HandleVisit)
+	count := http.HandlerFunc(s.HandleCount)
+	countries := http.HandlerFunc(s.HandleCountries)
+	regions := http.HandlerFunc(s.HandleRegions)
+	asn := http.HandlerFunc(s.HandleASN)
+	series := http.HandlerFunc(s.HandleSeries)
+	seriesCountries := http.HandlerFunc(s.HandleSeriesCountries)
+	if s.countCache != nil {
+		count = s.countCache.Wrap(count)
+	}
+	if s.countriesCache != nil {
+		countries = s.countriesCache.Wrap(countries)
+	}
+	if s.limiter != nil {
+		add = s.limiter.Wrap(add)
+		count = s.limiter.Wrap(count)
+		countries = s.limiter.Wrap(countries)
+		regions = s.limiter.Wrap(regions)
+		asn = s.limiter.Wrap(asn)
+		series = s.limiter.Wrap(series)
+		seriesCountries = s.limiter.Wrap(seriesCountries)
+	}
+	http.HandleFunc("/add", add)
+	registerFormatted("/count", count)
+	registerFormatted("/countries", countries)
+	registerFormatted("/regions", regions)
+	registerFormatted("/asn", asn)
+	http.HandleFunc("/series", series)
+	http.HandleFunc("/series/countries", seriesCountries)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", s.config.Section("").Key("port").MustInt(8000)), nil))
 }
 
+// registerFormatted registers h at pattern and at pattern+".json"/".xml"/
+// ".csv", so negotiateFormat's path-suffix rule has routes to actually
+// match against instead of 404ing before it's consulted.
+func registerFormatted(pattern string, h http.HandlerFunc) {
+	http.HandleFunc(pattern, h)
+	for _, suffix := range []string{".json", ".xml", ".csv"} {
+		http.HandleFunc(pattern+suffix, h)
+	}
+}
+
+// newLimiter builds the rate limiter described by the [ratelimit] section,
+// or nil if requests_per_hour isn't configured.
+func newLimiter(config *ini.File) *ratelimit.Limiter {
+	rl := config.Section("ratelimit")
+	rph := rl.Key("requests_per_hour").MustInt(0)
+	if rph <= 0 {
+		return nil
+	}
+	var quota ratelimit.Quota
+	if rl.Key("backend").MustString("memory") == "redis" {
+		quota = ratelimit.NewRedisQuota(rl.Key("redis_addr").String(), rl.Key("redis_password").String(), rph)
+	} else {
+		quota = ratelimit.NewMemoryQuota(rph, rl.Key("burst").MustInt(rph))
+	}
+	return ratelimit.NewLimiter(quota, rl.Key("trust_forwarded_for").MustBool(false))
+}
+
 func NewServer(configpath, fname, name string) (*Server, error) {
 	s := &Server{}
 	var err error
@@ -267,12 +287,21 @@ func NewServer(configpath, fname, name string) (*Server, error) {
 	if geoip != "" {
 		s.GeoIP = true
 	}
-	s.db, err = NewBoltDB(fname, name, geoip)
+	s.ActiveThreshold = storage.NewThreshold(s.config.Section("").Key("days").MustInt(0), s.config.Section("").Key("hours").MustInt(2), s.config.Section("").Key("minutes").MustInt(0))
+	driver := s.config.Section("storage").Key("driver").MustString("bolt")
+	s.db, err = storage.New(driver, s.config, fname, name, s.ActiveThreshold)
 	if err != nil {
 		return nil, err
 	}
-	s.ActiveThreshold = NewThreshold(s.config.Section("").Key("days").MustInt(0), s.config.Section("").Key("hours").MustInt(2), s.config.Section("").Key("minutes").MustInt(0))
 	s.hash = NewHMACSha256(s.config.Section("").Key("secret").String())
+	s.limiter = newLimiter(s.config)
+	cacheSec := s.config.Section("cache")
+	if secs := cacheSec.Key("cache_count_seconds").MustInt(30); secs > 0 {
+		s.countCache = httpcache.New(time.Duration(secs) * time.Second)
+	}
+	if secs := cacheSec.Key("cache_countries_seconds").MustInt(30); secs > 0 {
+		s.countriesCache = httpcache.New(time.Duration(secs) * time.Second)
+	}
 	return s, err
 }
 
@@ -284,6 +313,6 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to start: %v", err)
 	}
-	defer s.db.Close()
+	defer s.Close()
 	s.Serve()
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRequest(path, query, accept string) *http.Request {
+	url := path
+	if query != "" {
+		url += "?" + query
+	}
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	return r
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		path   string
+		query  string
+		accept string
+		want   string
+	}{
+		{"path suffix wins", "/count.xml", "format=json", "", "xml"},
+		{"query param", "/count", "format=csv", "application/xml", "csv"},
+		{"accept header xml", "/count", "", "text/xml", "xml"},
+		{"accept header csv", "/count", "", "text/csv", "csv"},
+		{"default json", "/count", "", "", "json"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := newTestRequest(c.path, c.query, c.accept)
+			if got := negotiateFormat(r); got != c.want {
+				t.Errorf("negotiateFormat(%q, %q, %q) = %q, want %q", c.path, c.query, c.accept, got, c.want)
+			}
+		})
+	}
+}
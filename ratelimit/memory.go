@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryQuota is an in-process token bucket per client key. It's the
+// zero-config default and is what NewServer picks when backend=memory.
+type MemoryQuota struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	rate    float64 // tokens granted per second
+	burst   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryQuota allows requestsPerHour sustained, with up to burst requests
+// in a single instant.
+func NewMemoryQuota(requestsPerHour, burst int) *MemoryQuota {
+	return &MemoryQuota{
+		buckets: make(map[string]*bucket),
+		rate:    float64(requestsPerHour) / 3600,
+		burst:   burst,
+	}
+}
+
+func (m *MemoryQuota) Allow(key string) (allowed bool, limit int, remaining int, reset time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(m.burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * m.rate
+	if b.tokens > float64(m.burst) {
+		b.tokens = float64(m.burst)
+	}
+	b.last = now
+	allowed = b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	reset = now
+	if m.rate > 0 {
+		reset = now.Add(time.Duration((float64(m.burst)-b.tokens)/m.rate) * time.Second)
+	}
+	return allowed, m.burst, int(b.tokens), reset, nil
+}
@@ -0,0 +1,9 @@
+package ratelimit
+
+import "time"
+
+// Quota decides whether the caller identified by key may proceed, and
+// reports the limit/remaining/reset values a Limiter surfaces as headers.
+type Quota interface {
+	Allow(key string) (allowed bool, limit int, remaining int, reset time.Time, err error)
+}
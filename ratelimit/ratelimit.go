@@ -0,0 +1,59 @@
+// Package ratelimit provides HTTP middleware that enforces a per-client
+// request quota, backed by a pluggable Quota implementation.
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Limiter is HTTP middleware that rejects requests once a client's Quota is
+// exhausted, reporting the standard X-RateLimit-* headers either way.
+type Limiter struct {
+	quota          Quota
+	trustForwarded bool
+}
+
+// NewLimiter builds a Limiter backed by quota. When trustForwarded is true,
+// the client key is taken from the first address in X-Forwarded-For instead
+// of the TCP peer address, for deployments behind a trusted proxy.
+func NewLimiter(quota Quota, trustForwarded bool) *Limiter {
+	return &Limiter{quota: quota, trustForwarded: trustForwarded}
+}
+
+func (l *Limiter) clientKey(r *http.Request) string {
+	if l.trustForwarded {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Wrap returns h guarded by the Limiter's Quota. Once the caller's quota is
+// exhausted, it responds 429 instead of calling h.
+func (l *Limiter) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := l.clientKey(r)
+		allowed, limit, remaining, reset, err := l.quota.Allow(key)
+		if err != nil {
+			// A backend error shouldn't take the whole API down with it.
+			h(w, r)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", reset.Unix()))
+		if !allowed {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
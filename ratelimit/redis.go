@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisQuota is a fixed-window counter shared across server instances via
+// Redis INCR+EXPIRE, for deployments running more than one ipcount process
+// behind the quota.
+type RedisQuota struct {
+	client *redis.Client
+	limit  int
+	window time.Duration
+}
+
+// NewRedisQuota allows requestsPerHour per key per fixed one-hour window,
+// which starts at the key's first request.
+func NewRedisQuota(addr, password string, requestsPerHour int) *RedisQuota {
+	return &RedisQuota{
+		client: redis.NewClient(&redis.Options{Addr: addr, Password: password}),
+		limit:  requestsPerHour,
+		window: time.Hour,
+	}
+}
+
+func (q *RedisQuota) Allow(key string) (allowed bool, limit int, remaining int, reset time.Time, err error) {
+	ctx := context.Background()
+	redisKey := "ipcount:ratelimit:" + key
+	count, err := q.client.Incr(ctx, redisKey).Result()
+	if err != nil {
+		return false, q.limit, 0, time.Time{}, err
+	}
+	if count == 1 {
+		if err := q.client.Expire(ctx, redisKey, q.window).Err(); err != nil {
+			return false, q.limit, 0, time.Time{}, err
+		}
+	}
+	ttl, err := q.client.TTL(ctx, redisKey).Result()
+	if err != nil || ttl < 0 {
+		ttl = q.window
+	}
+	remaining = q.limit - int(count)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return int(count) <= q.limit, q.limit, remaining, time.Now().Add(ttl), nil
+}
@@ -0,0 +1,487 @@
+// Package bolt is the BoltDB-backed storage.DB implementation: a single
+// local file holding a primary bucket plus the country/time secondary
+// indexes and the HLL series bucket.
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hrfee/ipcount/hll"
+	"github.com/hrfee/ipcount/storage"
+	bbolt "go.etcd.io/bbolt"
+	"gopkg.in/ini.v1"
+)
+
+func init() {
+	storage.Register("bolt", New)
+}
+
+// New builds a DB backed by the BoltDB file at fname, reading GeoIP and
+// series-retention settings from config.
+func New(config *ini.File, fname, name string, activeThreshold *storage.Threshold) (storage.DB, error) {
+	geoip := config.Section("").Key("geoip2_db").String()
+	retentionDays := config.Section("series").Key("retention_days").MustInt(90)
+	return NewBoltDB(fname, name, geoip, time.Duration(retentionDays)*24*time.Hour, activeThreshold)
+}
+
+var seriesName = []byte("ipcount_series")
+
+var (
+	// countryIndexName indexes entries by "<countryISO>/<hashKey>" so a
+	// single country's entries can be Seek'd directly.
+	countryIndexName = []byte("ipcount_by_country")
+	// timeIndexName indexes entries by "<unixLastVisitBE><hashKey>" so
+	// Cursor.Seek yields entries in time order, letting reads skip past
+	// expired ones without scanning them.
+	timeIndexName = []byte("ipcount_by_time")
+)
+
+// seriesKey is "<periodKind><unixBucketStart>", 9 bytes.
+func seriesKey(period byte, bucketStart int64) []byte {
+	k := make([]byte, 9)
+	k[0] = period
+	binary.BigEndian.PutUint64(k[1:], uint64(bucketStart))
+	return k
+}
+
+func countrySeriesKey(period byte, bucketStart int64, country string) []byte {
+	return append(seriesKey(period, bucketStart), []byte(country)...)
+}
+
+func periodBucketStart(period byte, t time.Time) int64 {
+	return t.Truncate(storage.PeriodDuration(period)).Unix()
+}
+
+// countryIndexKey is "<countryISO>/<hashKey>".
+func countryIndexKey(country string, hash []byte) []byte {
+	return append(append([]byte(country), '/'), hash...)
+}
+
+func countryIndexPrefix(country string) []byte {
+	return append([]byte(country), '/')
+}
+
+// timeIndexKey is "<unixLastVisitBE><hashKey>", 8+len(hash) bytes.
+func timeIndexKey(lastVisit time.Time, hash []byte) []byte {
+	k := make([]byte, 8+len(hash))
+	binary.BigEndian.PutUint64(k, uint64(lastVisit.Unix()))
+	copy(k[8:], hash)
+	return k
+}
+
+// timeIndexSeek is the 8-byte big-endian prefix Cursor.Seek uses to jump
+// straight to the first entry whose LastVisit is >= t.
+func timeIndexSeek(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.Unix()))
+	return k
+}
+
+type BoltDB struct {
+	db              *bbolt.DB
+	name            []byte
+	lock            *sync.Mutex
+	GeoIP           bool
+	GeoDB           *storage.GeoIP
+	seriesRetention time.Duration
+	activeThreshold *storage.Threshold
+	stopSweep       chan struct{}
+}
+
+func NewBoltDB(fname, name, geoip string, seriesRetention time.Duration, activeThreshold *storage.Threshold) (*BoltDB, error) {
+	b := &BoltDB{
+		GeoIP:           geoip != "",
+		seriesRetention: seriesRetention,
+		activeThreshold: activeThreshold,
+		stopSweep:       make(chan struct{}),
+	}
+	b.lock = &sync.Mutex{}
+	b.name = []byte(name)
+	var err error
+	b.db, err = bbolt.Open(fname, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{b.name, seriesName, countryIndexName, timeIndexName} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if b.GeoIP {
+		b.GeoDB, err = storage.OpenGeoIP(geoip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b.seriesRetention > 0 {
+		go b.sweepSeries()
+	}
+	go b.sweepExpiredLoop()
+	return b, err
+}
+
+// sweepSeries periodically prunes series buckets older than seriesRetention,
+// until Close stops it.
+func (b *BoltDB) sweepSeries() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.PruneSeries(b.seriesRetention)
+		case <-b.stopSweep:
+			return
+		}
+	}
+}
+
+// sweepExpiredLoop periodically deletes entries older than activeThreshold
+// from the primary bucket and both indexes, so read endpoints never need to
+// write. Stopped by Close.
+func (b *BoltDB) sweepExpiredLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.sweepExpired()
+		case <-b.stopSweep:
+			return
+		}
+	}
+}
+
+func (b *BoltDB) sweepExpired() error {
+	cutoff := timeIndexSeek(time.Now().Add(-b.activeThreshold.Duration()))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		timeIdx := tx.Bucket(timeIndexName)
+		primary := tx.Bucket(b.name)
+		countryIdx := tx.Bucket(countryIndexName)
+		type expiredEntry struct {
+			timeKey, hash []byte
+			country       string
+		}
+		var expired []expiredEntry
+		c := timeIdx.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], cutoff) < 0; k, v = c.Next() {
+			e := storage.DecodeEntry(v)
+			expired = append(expired, expiredEntry{append([]byte(nil), k...), append([]byte(nil), k[8:]...), e.CountryISOCode})
+		}
+		for _, e := range expired {
+			if err := timeIdx.Delete(e.timeKey); err != nil {
+				return err
+			}
+			if err := primary.Delete(e.hash); err != nil {
+				return err
+			}
+			if err := countryIdx.Delete(countryIndexKey(e.country, e.hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDB) Close() {
+	close(b.stopSweep)
+	b.db.Close()
+	if b.GeoIP {
+		b.GeoDB.Close()
+	}
+}
+
+func (b *BoltDB) LogVisit(hash []byte, t time.Time, ip ...string) error {
+	entry := &storage.Entry{LastVisit: t}
+	if len(ip) == 1 && b.GeoIP {
+		if geo, err := b.GeoDB.Lookup(net.ParseIP(ip[0])); err == nil {
+			geo.LastVisit = t
+			entry = geo
+		}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return b.putVisit(tx, hash, entry, t)
+	})
+}
+
+// Batch logs several visits in a single bbolt transaction, instead of one
+// per visit.
+func (b *BoltDB) Batch(visits []storage.Visit) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, v := range visits {
+			entry := &storage.Entry{LastVisit: v.Time}
+			if v.IP != "" && b.GeoIP {
+				if geo, err := b.GeoDB.Lookup(net.ParseIP(v.IP)); err == nil {
+					geo.LastVisit = v.Time
+					entry = geo
+				}
+			}
+			if err := b.putVisit(tx, v.Hash, entry, v.Time); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putVisit writes entry to the primary bucket and both indexes within tx,
+// clearing out any previous index entries for hash first.
+func (b *BoltDB) putVisit(tx *bbolt.Tx, hash []byte, entry *storage.Entry, t time.Time) error {
+	primary := tx.Bucket(b.name)
+	countryIdx := tx.Bucket(countryIndexName)
+	timeIdx := tx.Bucket(timeIndexName)
+	if old := primary.Get(hash); old != nil {
+		oldEntry := storage.DecodeEntry(old)
+		if err := countryIdx.Delete(countryIndexKey(oldEntry.CountryISOCode, hash)); err != nil {
+			return err
+		}
+		if err := timeIdx.Delete(timeIndexKey(oldEntry.LastVisit, hash)); err != nil {
+			return err
+		}
+	}
+	encoded := entry.Encode()
+	if err := primary.Put(hash, encoded); err != nil {
+		return err
+	}
+	if err := countryIdx.Put(countryIndexKey(entry.CountryISOCode, hash), encoded); err != nil {
+		return err
+	}
+	if err := timeIdx.Put(timeIndexKey(entry.LastVisit, hash), encoded); err != nil {
+		return err
+	}
+	return b.recordSeries(tx, hash, entry.CountryISOCode, t)
+}
+
+// recordSeries merges hash into the hour and day HLL sketches covering t,
+// both overall and (when country is known) per-country.
+func (b *BoltDB) recordSeries(tx *bbolt.Tx, hash []byte, country string, t time.Time) error {
+	bucket := tx.Bucket(seriesName)
+	for _, period := range []byte{storage.PeriodHour, storage.PeriodDay} {
+		start := periodBucketStart(period, t)
+		if err := mergeSketch(bucket, seriesKey(period, start), hash); err != nil {
+			return err
+		}
+		if country != "" {
+			if err := mergeSketch(bucket, countrySeriesKey(period, start, country), hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mergeSketch(bucket *bbolt.Bucket, key, element []byte) error {
+	sketch := hll.New()
+	if existing := bucket.Get(key); existing != nil {
+		if err := sketch.UnmarshalBinary(existing); err != nil {
+			return err
+		}
+	}
+	sketch.Add(element)
+	encoded, err := sketch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, encoded)
+}
+
+// SeriesCounts returns the estimated unique-visitor count for each of the
+// last n buckets of period, oldest first.
+func (b *BoltDB) SeriesCounts(period byte, n int) ([]int, error) {
+	now := time.Now()
+	counts := make([]int, n)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(seriesName)
+		for i := 0; i < n; i++ {
+			start := periodBucketStart(period, now.Add(-time.Duration(n-1-i)*storage.PeriodDuration(period)))
+			v := bucket.Get(seriesKey(period, start))
+			if v == nil {
+				continue
+			}
+			sketch := hll.New()
+			if err := sketch.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			counts[i] = int(sketch.Count())
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// SeriesCountryCounts returns the estimated unique-visitor count from
+// country for each of the last n buckets of period, oldest first.
+func (b *BoltDB) SeriesCountryCounts(period byte, country string, n int) ([]int, error) {
+	now := time.Now()
+	counts := make([]int, n)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(seriesName)
+		for i := 0; i < n; i++ {
+			start := periodBucketStart(period, now.Add(-time.Duration(n-1-i)*storage.PeriodDuration(period)))
+			v := bucket.Get(countrySeriesKey(period, start, country))
+			if v == nil {
+				continue
+			}
+			sketch := hll.New()
+			if err := sketch.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			counts[i] = int(sketch.Count())
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// PruneSeries deletes series buckets (of either period kind) older than
+// horizon.
+func (b *BoltDB) PruneSeries(horizon time.Duration) error {
+	cutoff := time.Now().Add(-horizon).Unix()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(seriesName)
+		var stale [][]byte
+		bucket.ForEach(func(k, _ []byte) error {
+			if len(k) < 9 {
+				return nil
+			}
+			if int64(binary.BigEndian.Uint64(k[1:9])) < cutoff {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDB) GetEntry(hash []byte) *storage.Entry {
+	var e *storage.Entry
+	b.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(b.name)
+		if v := bucket.Get(hash); v != nil {
+			e = storage.DecodeEntry(v)
+		}
+		return nil
+	})
+	return e
+}
+
+// CountActive counts entries last seen within ActiveThreshold. It Seeks the
+// time index straight to the threshold's cutoff and walks forward, so
+// expired entries (left for the background sweep) are skipped rather than
+// scanned.
+func (b *BoltDB) CountActive(ActiveThreshold *storage.Threshold) (count int) {
+	cutoff := timeIndexSeek(time.Now().Add(-ActiveThreshold.Duration()))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(timeIndexName).Cursor()
+		for k, _ := c.Seek(cutoff); k != nil; k, _ = c.Next() {
+			count++
+		}
+		return nil
+	})
+	return
+}
+
+// CountByCountry counts entries last seen within ActiveThreshold, grouped by
+// country. Like CountActive, it Seeks the time index to the cutoff instead
+// of scanning every entry.
+func (b *BoltDB) CountByCountry(ActiveThreshold *storage.Threshold) (counts map[string]int) {
+	counts = map[string]int{"Total": 0}
+	cutoff := timeIndexSeek(time.Now().Add(-ActiveThreshold.Duration()))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(timeIndexName).Cursor()
+		for k, v := c.Seek(cutoff); k != nil; k, v = c.Next() {
+			e := storage.DecodeEntry(v)
+			counts["Total"]++
+			country := e.CountryISOCode
+			if country == "" {
+				country = "Unknown"
+			}
+			counts[country]++
+		}
+		return nil
+	})
+	return counts
+}
+
+// CountBySubdivision counts entries from country last seen within
+// ActiveThreshold, grouped by GeoIP2 subdivision ISO code. It Seeks the
+// country index straight to that country's key range, so other countries'
+// entries are never touched.
+func (b *BoltDB) CountBySubdivision(country string, ActiveThreshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	prefix := countryIndexPrefix(country)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(countryIndexName).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			e := storage.DecodeEntry(v)
+			if !ActiveThreshold.Valid(e.LastVisit) {
+				continue
+			}
+			counts["Total"]++
+			subdivision := e.SubdivisionISOCode
+			if subdivision == "" {
+				subdivision = "Unknown"
+			}
+			counts[subdivision]++
+		}
+		return nil
+	})
+	return counts
+}
+
+// CountByASN counts entries last seen within ActiveThreshold, grouped by
+// autonomous system number. Like CountActive, it Seeks the time index to
+// the cutoff instead of scanning every entry.
+func (b *BoltDB) CountByASN(ActiveThreshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	cutoff := timeIndexSeek(time.Now().Add(-ActiveThreshold.Duration()))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(timeIndexName).Cursor()
+		for k, v := c.Seek(cutoff); k != nil; k, v = c.Next() {
+			e := storage.DecodeEntry(v)
+			counts["Total"]++
+			asn := "Unknown"
+			if e.ASN != 0 {
+				asn = strconv.FormatUint(uint64(e.ASN), 10)
+			}
+			counts[asn]++
+		}
+		return nil
+	})
+	return counts
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Entry stores information about a hashed IP. SubdivisionISOCode,
+// CityGeonameID and ASN are only populated when GeoIP is configured with a
+// City or ASN database; Encode keeps the original fixed 16-byte layout for
+// plain country records, so installs that don't upgrade their GeoIP
+// database pay nothing for the richer fields.
+type Entry struct {
+	LastVisit time.Time // Last visit from user
+	// Count     int       // Visit count
+	CountryISOCode     string // GeoIP2 Country ID.
+	SubdivisionISOCode string // GeoIP2 City DB: first subdivision ID.
+	CityGeonameID      uint32 // GeoIP2 City DB: city geoname ID.
+	ASN                uint32 // GeoIP2 ASN DB: autonomous system number.
+}
+
+// entryVersionV1 marks the variable-length encoding used once any of the
+// City/ASN fields are set. Legacy 16-byte records have no version byte;
+// DecodeEntry tells the two apart by length.
+const entryVersionV1 = 1
+
+func (e *Entry) Encode() []byte {
+	if e.SubdivisionISOCode == "" && e.CityGeonameID == 0 && e.ASN == 0 {
+		return e.encodeLegacy()
+	}
+	return e.encodeV1()
+}
+
+func (e *Entry) encodeLegacy() []byte {
+	unix := e.LastVisit.Unix()
+	out := make([]byte, 16)
+	country := []byte(e.CountryISOCode)
+	binary.LittleEndian.PutUint64(out, uint64(unix))
+	for i := 8; i < 8+len(country); i++ {
+		out[i] = country[i-8]
+	}
+	return out
+}
+
+func (e *Entry) encodeV1() []byte {
+	country := []byte(e.CountryISOCode)
+	subdivision := []byte(e.SubdivisionISOCode)
+	out := make([]byte, 1, 1+8+1+len(country)+1+len(subdivision)+4+4)
+	out[0] = entryVersionV1
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(e.LastVisit.Unix()))
+	out = append(out, buf[:]...)
+	out = append(out, byte(len(country)))
+	out = append(out, country...)
+	out = append(out, byte(len(subdivision)))
+	out = append(out, subdivision...)
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], e.CityGeonameID)
+	out = append(out, id[:]...)
+	binary.LittleEndian.PutUint32(id[:], e.ASN)
+	out = append(out, id[:]...)
+	return out
+}
+
+// DecodeEntry decodes an Entry written by Encode, transparently migrating
+// the original 16-byte layout (identified by its fixed length) as well as
+// the versioned variable-length one.
+func DecodeEntry(b []byte) (e *Entry) {
+	if len(b) == 16 {
+		return decodeLegacyEntry(b)
+	}
+	return decodeV1Entry(b)
+}
+
+func decodeLegacyEntry(b []byte) (e *Entry) {
+	e = &Entry{}
+	e.CountryISOCode = ""
+	for i := 8; i < 16; i++ {
+		if b[i] != 0 {
+			e.CountryISOCode += string(b[i])
+			b[i] = 0
+		}
+	}
+	e.LastVisit = time.Unix(int64(binary.LittleEndian.Uint64(b)), 0)
+	return
+}
+
+func decodeV1Entry(b []byte) (e *Entry) {
+	e = &Entry{}
+	i := 1 // b[0] is the version byte; only version 1 exists so far.
+	e.LastVisit = time.Unix(int64(binary.LittleEndian.Uint64(b[i:i+8])), 0)
+	i += 8
+	countryLen := int(b[i])
+	i++
+	e.CountryISOCode = string(b[i : i+countryLen])
+	i += countryLen
+	subdivisionLen := int(b[i])
+	i++
+	e.SubdivisionISOCode = string(b[i : i+subdivisionLen])
+	i += subdivisionLen
+	e.CityGeonameID = binary.LittleEndian.Uint32(b[i : i+4])
+	i += 4
+	e.ASN = binary.LittleEndian.Uint32(b[i : i+4])
+	return e
+}
+
+// Threshold is a rolling "still active" window.
+type Threshold struct {
+	duration time.Duration
+}
+
+func NewThreshold(days, hours, minutes int) *Threshold {
+	return &Threshold{(time.Duration((days*24)+hours) * time.Hour) + (time.Duration(minutes) * time.Minute)}
+}
+
+func (threshold *Threshold) Valid(t time.Time) bool {
+	return t.Add(threshold.duration).After(time.Now())
+}
+
+// Duration returns the window's length, for backends that need it directly
+// (e.g. to set a native TTL).
+func (threshold *Threshold) Duration() time.Duration {
+	return threshold.duration
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIP wraps an open GeoIP2 database, dispatching each Lookup to the
+// Country, City or ASN reader method based on the database's declared type,
+// so backends don't need to configure which kind they're using. Shared by
+// every storage.DB implementation that supports GeoIP (bolt, memory,
+// redis).
+type GeoIP struct {
+	reader *geoip2.Reader
+}
+
+// OpenGeoIP opens the GeoIP2 database at path. An empty path means GeoIP is
+// disabled for this install; it returns a nil *GeoIP and no error, and
+// Lookup/Close on a nil *GeoIP are no-ops.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	if path == "" {
+		return nil, nil
+	}
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader: reader}, nil
+}
+
+// Close releases the underlying database file.
+func (g *GeoIP) Close() {
+	if g == nil {
+		return
+	}
+	g.reader.Close()
+}
+
+// Lookup resolves ip: an ASN database yields only Entry.ASN, a City
+// database the country, first subdivision and city geoname ID, and
+// anything else (a plain Country database) just the country.
+func (g *GeoIP) Lookup(ip net.IP) (*Entry, error) {
+	e := &Entry{}
+	if g == nil {
+		return e, nil
+	}
+	switch dbType := g.reader.Metadata().DatabaseType; {
+	case strings.Contains(dbType, "ASN"):
+		record, err := g.reader.ASN(ip)
+		if err != nil {
+			return nil, err
+		}
+		e.ASN = uint32(record.AutonomousSystemNumber)
+	case strings.Contains(dbType, "City"):
+		record, err := g.reader.City(ip)
+		if err != nil {
+			return nil, err
+		}
+		e.CountryISOCode = record.Country.IsoCode
+		if len(record.Subdivisions) > 0 {
+			e.SubdivisionISOCode = record.Subdivisions[0].IsoCode
+		}
+		e.CityGeonameID = uint32(record.City.GeoNameID)
+	default:
+		record, err := g.reader.Country(ip)
+		if err != nil {
+			return nil, err
+		}
+		e.CountryISOCode = record.Country.IsoCode
+	}
+	return e, nil
+}
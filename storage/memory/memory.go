@@ -0,0 +1,193 @@
+// Package memory is a sync.Map-backed storage.DB implementation: nothing
+// is persisted to disk, which makes it useful for tests and ephemeral
+// deployments.
+package memory
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hrfee/ipcount/storage"
+	"gopkg.in/ini.v1"
+)
+
+func init() {
+	storage.Register("memory", New)
+}
+
+// New builds a memory-backed DB. fname and name are unused; memory has
+// nothing to load from disk. config is read for the same geoip2_db setting
+// bolt uses, so GeoIP works identically regardless of storage driver.
+func New(config *ini.File, fname, name string, activeThreshold *storage.Threshold) (storage.DB, error) {
+	geoip, err := storage.OpenGeoIP(config.Section("").Key("geoip2_db").String())
+	if err != nil {
+		return nil, err
+	}
+	return NewDB(geoip), nil
+}
+
+type seriesBucket struct {
+	seen map[string]struct{}
+}
+
+// DB is an in-process storage.DB with no on-disk component.
+type DB struct {
+	entries  sync.Map // hash string -> *storage.Entry
+	seriesMu sync.Mutex
+	series   map[string]*seriesBucket
+	geoip    *storage.GeoIP
+}
+
+// NewDB returns an empty DB. geoip may be nil, in which case LogVisit never
+// resolves an entry's GeoIP fields.
+func NewDB(geoip *storage.GeoIP) *DB {
+	return &DB{series: make(map[string]*seriesBucket), geoip: geoip}
+}
+
+func (d *DB) Close() {
+	d.geoip.Close()
+}
+
+func (d *DB) LogVisit(hash []byte, t time.Time, ip ...string) error {
+	entry := &storage.Entry{LastVisit: t}
+	if len(ip) == 1 && d.geoip != nil {
+		if geo, err := d.geoip.Lookup(net.ParseIP(ip[0])); err == nil {
+			geo.LastVisit = t
+			entry = geo
+		}
+	}
+	d.entries.Store(string(hash), entry)
+	d.record(hash, entry.CountryISOCode, t)
+	return nil
+}
+
+func (d *DB) Batch(visits []storage.Visit) error {
+	return storage.BatchLoop(d, visits)
+}
+
+func (d *DB) GetEntry(hash []byte) *storage.Entry {
+	v, ok := d.entries.Load(string(hash))
+	if !ok {
+		return nil
+	}
+	return v.(*storage.Entry)
+}
+
+func (d *DB) CountActive(threshold *storage.Threshold) (count int) {
+	d.entries.Range(func(_, v interface{}) bool {
+		if threshold.Valid(v.(*storage.Entry).LastVisit) {
+			count++
+		}
+		return true
+	})
+	return
+}
+
+func (d *DB) CountByCountry(threshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	d.entries.Range(func(_, v interface{}) bool {
+		e := v.(*storage.Entry)
+		if !threshold.Valid(e.LastVisit) {
+			return true
+		}
+		counts["Total"]++
+		country := e.CountryISOCode
+		if country == "" {
+			country = "Unknown"
+		}
+		counts[country]++
+		return true
+	})
+	return counts
+}
+
+// CountBySubdivision counts active entries within country, grouped by
+// GeoIP2 subdivision ISO code.
+func (d *DB) CountBySubdivision(country string, threshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	d.entries.Range(func(_, v interface{}) bool {
+		e := v.(*storage.Entry)
+		if e.CountryISOCode != country || !threshold.Valid(e.LastVisit) {
+			return true
+		}
+		counts["Total"]++
+		subdivision := e.SubdivisionISOCode
+		if subdivision == "" {
+			subdivision = "Unknown"
+		}
+		counts[subdivision]++
+		return true
+	})
+	return counts
+}
+
+// CountByASN counts active entries grouped by autonomous system number.
+func (d *DB) CountByASN(threshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	d.entries.Range(func(_, v interface{}) bool {
+		e := v.(*storage.Entry)
+		if !threshold.Valid(e.LastVisit) {
+			return true
+		}
+		counts["Total"]++
+		asn := "Unknown"
+		if e.ASN != 0 {
+			asn = strconv.FormatUint(uint64(e.ASN), 10)
+		}
+		counts[asn]++
+		return true
+	})
+	return counts
+}
+
+func (d *DB) record(hash []byte, country string, t time.Time) {
+	d.seriesMu.Lock()
+	defer d.seriesMu.Unlock()
+	for _, period := range []byte{storage.PeriodHour, storage.PeriodDay} {
+		start := t.Truncate(storage.PeriodDuration(period)).Unix()
+		d.bucket(period, start, "").seen[string(hash)] = struct{}{}
+		if country != "" {
+			d.bucket(period, start, country).seen[string(hash)] = struct{}{}
+		}
+	}
+}
+
+func (d *DB) bucket(period byte, start int64, country string) *seriesBucket {
+	key := seriesMapKey(period, start, country)
+	b, ok := d.series[key]
+	if !ok {
+		b = &seriesBucket{seen: make(map[string]struct{})}
+		d.series[key] = b
+	}
+	return b
+}
+
+func seriesMapKey(period byte, start int64, country string) string {
+	return fmt.Sprintf("%c%d/%s", period, start, country)
+}
+
+func (d *DB) SeriesCounts(period byte, n int) ([]int, error) {
+	return d.seriesCounts(period, "", n), nil
+}
+
+func (d *DB) SeriesCountryCounts(period byte, country string, n int) ([]int, error) {
+	return d.seriesCounts(period, country, n), nil
+}
+
+func (d *DB) seriesCounts(period byte, country string, n int) []int {
+	now := time.Now()
+	dur := storage.PeriodDuration(period)
+	counts := make([]int, n)
+	d.seriesMu.Lock()
+	defer d.seriesMu.Unlock()
+	for i := 0; i < n; i++ {
+		start := now.Add(-time.Duration(n-1-i) * dur).Truncate(dur).Unix()
+		if b, ok := d.series[seriesMapKey(period, start, country)]; ok {
+			counts[i] = len(b.seen)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,251 @@
+// Package redis is a Redis-backed storage.DB implementation: entries are
+// hashes carrying a native TTL for active-window semantics, aggregated via
+// SCAN, with series buckets kept as sets.
+package redis
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hrfee/ipcount/storage"
+	"gopkg.in/ini.v1"
+)
+
+func init() {
+	storage.Register("redis", New)
+}
+
+// New builds a Redis-backed DB from the [storage] section's redis_addr and
+// redis_password keys. config is also read for the same geoip2_db setting
+// bolt uses, so GeoIP works identically regardless of storage driver.
+func New(config *ini.File, fname, name string, activeThreshold *storage.Threshold) (storage.DB, error) {
+	sec := config.Section("storage")
+	client := redis.NewClient(&redis.Options{
+		Addr:     sec.Key("redis_addr").MustString("localhost:6379"),
+		Password: sec.Key("redis_password").String(),
+	})
+	geoip, err := storage.OpenGeoIP(config.Section("").Key("geoip2_db").String())
+	if err != nil {
+		return nil, err
+	}
+	retentionDays := config.Section("series").Key("retention_days").MustInt(90)
+	return NewDB(client, name, activeThreshold, time.Duration(retentionDays)*24*time.Hour, geoip), nil
+}
+
+// DB is a Redis-backed storage.DB.
+type DB struct {
+	client          *redis.Client
+	prefix          string
+	activeThreshold *storage.Threshold
+	seriesRetention time.Duration
+	geoip           *storage.GeoIP
+}
+
+// NewDB wraps an existing Redis client. geoip may be nil, in which case
+// LogVisit never resolves an entry's GeoIP fields.
+func NewDB(client *redis.Client, prefix string, activeThreshold *storage.Threshold, seriesRetention time.Duration, geoip *storage.GeoIP) *DB {
+	return &DB{client: client, prefix: prefix, activeThreshold: activeThreshold, seriesRetention: seriesRetention, geoip: geoip}
+}
+
+func (d *DB) entryKey(hash []byte) string {
+	return fmt.Sprintf("%s:entry:%s", d.prefix, hex.EncodeToString(hash))
+}
+
+func (d *DB) seriesKey(period byte, start int64, country string) string {
+	if country == "" {
+		return fmt.Sprintf("%s:series:%c%d", d.prefix, period, start)
+	}
+	return fmt.Sprintf("%s:series:%c%d:%s", d.prefix, period, start, country)
+}
+
+func (d *DB) Close() {
+	d.client.Close()
+	d.geoip.Close()
+}
+
+// entryForVisit resolves ip against geoip when one is configured, falling
+// back to a bare entry otherwise.
+func (d *DB) entryForVisit(ip string, t time.Time) *storage.Entry {
+	if ip != "" && d.geoip != nil {
+		if geo, err := d.geoip.Lookup(net.ParseIP(ip)); err == nil {
+			geo.LastVisit = t
+			return geo
+		}
+	}
+	return &storage.Entry{LastVisit: t}
+}
+
+func (d *DB) LogVisit(hash []byte, t time.Time, ip ...string) error {
+	ctx := context.Background()
+	pipe := d.client.TxPipeline()
+	var entryIP string
+	if len(ip) == 1 {
+		entryIP = ip[0]
+	}
+	d.queueVisit(ctx, pipe, hash, d.entryForVisit(entryIP, t), t)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Batch pipelines every visit into a single round trip.
+func (d *DB) Batch(visits []storage.Visit) error {
+	ctx := context.Background()
+	pipe := d.client.Pipeline()
+	for _, v := range visits {
+		d.queueVisit(ctx, pipe, v.Hash, d.entryForVisit(v.IP, v.Time), v.Time)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// queueVisit appends the commands for one visit to pipe: the entry hash
+// (with its TTL providing active-window expiry) plus its hour/day series
+// sets.
+func (d *DB) queueVisit(ctx context.Context, pipe redis.Pipeliner, hash []byte, entry *storage.Entry, t time.Time) {
+	key := d.entryKey(hash)
+	pipe.HSet(ctx, key, "t", entry.LastVisit.Unix(), "c", entry.CountryISOCode, "s", entry.SubdivisionISOCode, "g", entry.CityGeonameID, "a", entry.ASN)
+	pipe.Expire(ctx, key, d.activeThreshold.Duration())
+	for _, period := range []byte{storage.PeriodHour, storage.PeriodDay} {
+		start := t.Truncate(storage.PeriodDuration(period)).Unix()
+		overall := d.seriesKey(period, start, "")
+		pipe.SAdd(ctx, overall, string(hash))
+		pipe.Expire(ctx, overall, d.seriesRetention)
+		if entry.CountryISOCode != "" {
+			byCountry := d.seriesKey(period, start, entry.CountryISOCode)
+			pipe.SAdd(ctx, byCountry, string(hash))
+			pipe.Expire(ctx, byCountry, d.seriesRetention)
+		}
+	}
+}
+
+func (d *DB) GetEntry(hash []byte) *storage.Entry {
+	ctx := context.Background()
+	res, err := d.client.HMGet(ctx, d.entryKey(hash), "t", "c", "s", "g", "a").Result()
+	if err != nil || res[0] == nil {
+		return nil
+	}
+	unix, _ := strconv.ParseInt(res[0].(string), 10, 64)
+	return &storage.Entry{LastVisit: time.Unix(unix, 0), CountryISOCode: fieldString(res, 1), SubdivisionISOCode: fieldString(res, 2), CityGeonameID: fieldUint32(res, 3), ASN: fieldUint32(res, 4)}
+}
+
+func fieldString(res []interface{}, i int) string {
+	if res[i] == nil {
+		return ""
+	}
+	return res[i].(string)
+}
+
+func fieldUint32(res []interface{}, i int) uint32 {
+	if res[i] == nil {
+		return 0
+	}
+	v, _ := strconv.ParseUint(res[i].(string), 10, 32)
+	return uint32(v)
+}
+
+// scanEntries walks every live entry key via SCAN (rather than KEYS, to
+// avoid blocking the server), calling fn with each entry.
+func (d *DB) scanEntries(fn func(e *storage.Entry)) error {
+	ctx := context.Background()
+	pattern := d.prefix + ":entry:*"
+	var cursor uint64
+	for {
+		keys, next, err := d.client.Scan(ctx, cursor, pattern, 100).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			res, err := d.client.HMGet(ctx, key, "c", "s", "g", "a").Result()
+			if err != nil {
+				return err
+			}
+			fn(&storage.Entry{CountryISOCode: fieldString(res, 0), SubdivisionISOCode: fieldString(res, 1), CityGeonameID: fieldUint32(res, 2), ASN: fieldUint32(res, 3)})
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// CountActive counts live entry keys. Expiry is handled natively by each
+// key's TTL, so every key SCAN finds is by definition active.
+func (d *DB) CountActive(threshold *storage.Threshold) (count int) {
+	d.scanEntries(func(*storage.Entry) { count++ })
+	return
+}
+
+func (d *DB) CountByCountry(threshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	d.scanEntries(func(e *storage.Entry) {
+		counts["Total"]++
+		country := e.CountryISOCode
+		if country == "" {
+			country = "Unknown"
+		}
+		counts[country]++
+	})
+	return counts
+}
+
+// CountBySubdivision counts live entries within country, grouped by GeoIP2
+// subdivision ISO code.
+func (d *DB) CountBySubdivision(country string, threshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	d.scanEntries(func(e *storage.Entry) {
+		if e.CountryISOCode != country {
+			return
+		}
+		counts["Total"]++
+		subdivision := e.SubdivisionISOCode
+		if subdivision == "" {
+			subdivision = "Unknown"
+		}
+		counts[subdivision]++
+	})
+	return counts
+}
+
+// CountByASN counts live entries grouped by autonomous system number.
+func (d *DB) CountByASN(threshold *storage.Threshold) map[string]int {
+	counts := map[string]int{"Total": 0}
+	d.scanEntries(func(e *storage.Entry) {
+		counts["Total"]++
+		asn := "Unknown"
+		if e.ASN != 0 {
+			asn = strconv.FormatUint(uint64(e.ASN), 10)
+		}
+		counts[asn]++
+	})
+	return counts
+}
+
+func (d *DB) SeriesCounts(period byte, n int) ([]int, error) {
+	return d.seriesCounts(period, "", n)
+}
+
+func (d *DB) SeriesCountryCounts(period byte, country string, n int) ([]int, error) {
+	return d.seriesCounts(period, country, n)
+}
+
+func (d *DB) seriesCounts(period byte, country string, n int) ([]int, error) {
+	ctx := context.Background()
+	now := time.Now()
+	dur := storage.PeriodDuration(period)
+	counts := make([]int, n)
+	for i := 0; i < n; i++ {
+		start := now.Add(-time.Duration(n-1-i) * dur).Truncate(dur).Unix()
+		c, err := d.client.SCard(ctx, d.seriesKey(period, start, country)).Result()
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = int(c)
+	}
+	return counts, nil
+}
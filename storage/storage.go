@@ -0,0 +1,105 @@
+// Package storage defines the DB interface ipcount's HTTP handlers are
+// built against, and a registry so the driver can be chosen by config
+// instead of hardcoded in main.
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Period kinds accepted by SeriesCounts/SeriesCountryCounts.
+const (
+	PeriodHour byte = 'h'
+	PeriodDay  byte = 'd'
+)
+
+// ParsePeriod turns "hour"/"day" into a Period kind.
+func ParsePeriod(s string) (byte, error) {
+	switch s {
+	case "hour":
+		return PeriodHour, nil
+	case "day":
+		return PeriodDay, nil
+	}
+	return 0, fmt.Errorf("unknown period %q", s)
+}
+
+// PeriodDuration is the bucket width for period.
+func PeriodDuration(period byte) time.Duration {
+	if period == PeriodDay {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+// Visit is one logged visit, used by Batch to submit several at once.
+type Visit struct {
+	Hash []byte
+	Time time.Time
+	IP   string // empty if no IP was supplied
+}
+
+// DB is implemented by each storage backend (see storage/bolt,
+// storage/memory, storage/redis).
+type DB interface {
+	Close()
+	LogVisit(hash []byte, t time.Time, ip ...string) error
+	// Batch logs several visits at once. Backends that benefit from
+	// pipelining or transaction coalescing can do so here; others may just
+	// loop over LogVisit.
+	Batch(visits []Visit) error
+	GetEntry(hash []byte) *Entry
+	CountActive(*Threshold) int
+	CountByCountry(*Threshold) map[string]int
+	// CountBySubdivision counts active entries within country, grouped by
+	// GeoIP2 subdivision ISO code ("Unknown" if the GeoIP database doesn't
+	// resolve one).
+	CountBySubdivision(country string, threshold *Threshold) map[string]int
+	// CountByASN counts active entries grouped by autonomous system number
+	// ("Unknown" if the GeoIP database doesn't resolve one).
+	CountByASN(*Threshold) map[string]int
+	SeriesCounts(period byte, n int) ([]int, error)
+	SeriesCountryCounts(period byte, country string, n int) ([]int, error)
+}
+
+// Factory builds a DB for one driver. fname is the path to the backend's
+// local data file, if any; name is the primary bucket/table/keyspace name.
+type Factory func(config *ini.File, fname, name string, activeThreshold *Threshold) (DB, error)
+
+var registry = map[string]Factory{}
+
+// Register adds a Factory under a driver name ("bolt", "memory", "redis",
+// ...). Backend packages call this from an init() function.
+func Register(name string, f Factory) {
+	registry[name] = f
+}
+
+// New builds the DB for driver, using config, fname and name as the
+// Factory sees fit.
+func New(driver string, config *ini.File, fname, name string, activeThreshold *Threshold) (DB, error) {
+	f, ok := registry[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+	return f(config, fname, name, activeThreshold)
+}
+
+// BatchLoop is the straightforward Batch fallback: call LogVisit once per
+// Visit. Backends without a cheaper bulk path can use it directly.
+func BatchLoop(db DB, visits []Visit) error {
+	for _, v := range visits {
+		var err error
+		if v.IP != "" {
+			err = db.LogVisit(v.Hash, v.Time, v.IP)
+		} else {
+			err = db.LogVisit(v.Hash, v.Time)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}